@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+// This file implements just enough of kamailio's BINRPC wire protocol to
+// send a method-call request over TCP and decode its reply.  The vendored
+// github.com/CyCoreSystems/go-kamailio/binrpc client only ever sends
+// fire-and-forget requests over UDP (see its use in notify.go's
+// dispatcher.reload call) and has no reply-reading support, which is the
+// gap this request asks to close.  Rather than assume an API that package
+// doesn't have, we speak the wire protocol directly here for the one thing
+// we need: dispatcher.list over TCP.
+//
+// Packet layout: a 1-byte header ((0xA<<4)|lenBytes) naming how many
+// following bytes encode the total packet length, that length itself, a
+// counted cookie matching the request to its reply, and a body of
+// nibble-tagged records (int, string, struct, array) that mirrors how
+// kamailio's ctl/binrpc module frames both calls and replies.
+
+type binrpcType byte
+
+const (
+	binrpcInt    binrpcType = 0x0
+	binrpcStr    binrpcType = 0x1
+	binrpcDouble binrpcType = 0x2
+	binrpcStruct binrpcType = 0x3
+	binrpcArray  binrpcType = 0x4
+)
+
+const binrpcMagic = 0xA
+
+// binrpcValue is a decoded reply record: int64, string, []binrpcValue (an
+// ARRAY), or map[string]binrpcValue (a STRUCT).
+type binrpcValue interface{}
+
+// queryTCP opens a TCP connection to host:port, sends method as a BINRPC
+// request, and returns the decoded reply records.
+func queryTCP(ctx context.Context, host, port, method string) ([]binrpcValue, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to dial kamailio rpc over tcp")
+	}
+	defer conn.Close() // nolint: errcheck
+
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return nil, errors.Wrap(err, "failed to set connection deadline")
+		}
+	}
+
+	cookie := make([]byte, 4)
+	if _, err := rand.Read(cookie); err != nil {
+		return nil, errors.Wrap(err, "failed to generate request cookie")
+	}
+
+	req, err := encodeBinRPCRequest(cookie, method)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to encode binrpc request")
+	}
+
+	if _, err := conn.Write(req); err != nil {
+		return nil, errors.Wrap(err, "failed to write binrpc request")
+	}
+
+	records, err := decodeBinRPCReply(conn, cookie)
+	return records, errors.Wrap(err, "failed to decode binrpc reply")
+}
+
+// encodeBinRPCRequest frames a single STRING record (the method name) as a
+// BINRPC request packet with the given cookie.
+func encodeBinRPCRequest(cookie []byte, method string) ([]byte, error) {
+	var body bytes.Buffer
+	if err := encodeRecord(&body, binrpcStr, []byte(method)); err != nil {
+		return nil, err
+	}
+
+	var cookieField bytes.Buffer
+	cookieField.WriteByte(byte(len(cookie)))
+	cookieField.Write(cookie)
+
+	payloadLen := cookieField.Len() + body.Len()
+	lenBytes := minimalLenBytes(payloadLen)
+
+	var out bytes.Buffer
+	out.WriteByte(byte(binrpcMagic<<4) | byte(len(lenBytes)))
+	out.Write(lenBytes)
+	out.Write(cookieField.Bytes())
+	out.Write(body.Bytes())
+
+	return out.Bytes(), nil
+}
+
+// encodeRecord writes a single nibble-tagged record.  Only STR (length-
+// prefixed raw bytes) is supported; any other type returns an error.
+func encodeRecord(buf *bytes.Buffer, typ binrpcType, data []byte) error {
+	switch typ {
+	case binrpcStr:
+		lenBytes := minimalLenBytes(len(data))
+		buf.WriteByte(byte(typ<<4) | byte(len(lenBytes)))
+		buf.Write(lenBytes)
+		buf.Write(data)
+		return nil
+	default:
+		return errors.Errorf("encoding binrpc type %d is not supported", typ)
+	}
+}
+
+// minimalLenBytes returns n encoded as the fewest big-endian bytes that can
+// hold it (zero bytes for n == 0).
+func minimalLenBytes(n int) []byte {
+	if n == 0 {
+		return nil
+	}
+
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(n))
+
+	i := 0
+	for i < len(buf)-1 && buf[i] == 0 {
+		i++
+	}
+	return buf[i:]
+}
+
+// decodeBinRPCReply reads one BINRPC packet from r, verifies its cookie
+// matches the request, and decodes its body into a slice of top-level
+// records.
+func decodeBinRPCReply(r io.Reader, wantCookie []byte) ([]binrpcValue, error) {
+	header := make([]byte, 1)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, errors.Wrap(err, "failed to read packet header")
+	}
+	if header[0]>>4 != binrpcMagic {
+		return nil, errors.New("reply is missing the binrpc magic marker")
+	}
+
+	lenBytes := int(header[0] & 0x0f)
+	packetLen, err := readUint(r, lenBytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read packet length")
+	}
+
+	body := make([]byte, packetLen)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, errors.Wrap(err, "failed to read packet body")
+	}
+	buf := bytes.NewReader(body)
+
+	cookieLenByte, err := buf.ReadByte()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read cookie length")
+	}
+	cookie := make([]byte, cookieLenByte)
+	if _, err := io.ReadFull(buf, cookie); err != nil {
+		return nil, errors.Wrap(err, "failed to read cookie")
+	}
+	if !bytes.Equal(cookie, wantCookie) {
+		return nil, errors.New("reply cookie does not match request")
+	}
+
+	var records []binrpcValue
+	for buf.Len() > 0 {
+		v, err := decodeRecord(buf)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, v)
+	}
+	return records, nil
+}
+
+// decodeRecord reads one nibble-tagged record (and, recursively, its
+// children for STRUCT/ARRAY) from buf.
+func decodeRecord(buf *bytes.Reader) (binrpcValue, error) {
+	header, err := buf.ReadByte()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read record header")
+	}
+
+	typ := binrpcType(header >> 4)
+	n := int(header & 0x0f)
+
+	switch typ {
+	case binrpcInt:
+		v, err := readUint(buf, n)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read int record")
+		}
+		return int64(v), nil
+
+	case binrpcStr:
+		strLen, err := readUint(buf, n)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read string length")
+		}
+		data := make([]byte, strLen)
+		if _, err := io.ReadFull(buf, data); err != nil {
+			return nil, errors.Wrap(err, "failed to read string data")
+		}
+		return string(data), nil
+
+	case binrpcArray:
+		count, err := readUint(buf, n)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read array length")
+		}
+		arr := make([]binrpcValue, 0, count)
+		for i := uint64(0); i < count; i++ {
+			v, err := decodeRecord(buf)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, v)
+		}
+		return arr, nil
+
+	case binrpcStruct:
+		count, err := readUint(buf, n)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read struct member count")
+		}
+		members := make(map[string]binrpcValue, count)
+		for i := uint64(0); i < count; i++ {
+			nameLenByte, err := buf.ReadByte()
+			if err != nil {
+				return nil, errors.Wrap(err, "failed to read struct member name length")
+			}
+			name := make([]byte, nameLenByte)
+			if _, err := io.ReadFull(buf, name); err != nil {
+				return nil, errors.Wrap(err, "failed to read struct member name")
+			}
+			v, err := decodeRecord(buf)
+			if err != nil {
+				return nil, err
+			}
+			members[string(name)] = v
+		}
+		return members, nil
+
+	default:
+		return nil, errors.Errorf("unsupported binrpc record type %d", typ)
+	}
+}
+
+// readUint reads n big-endian bytes (0-8) from r as an unsigned integer;
+// n == 0 reads nothing and returns 0, matching BINRPC's compact int/length
+// encoding.
+func readUint(r io.Reader, n int) (uint64, error) {
+	if n == 0 {
+		return 0, nil
+	}
+	if n > 8 {
+		return 0, errors.Errorf("length field of %d bytes is too wide", n)
+	}
+
+	var buf [8]byte
+	if _, err := io.ReadFull(r, buf[8-n:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(buf[:]), nil
+}
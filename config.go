@@ -0,0 +1,193 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"text/template"
+
+	"github.com/ghodss/yaml"
+	"github.com/pkg/errors"
+)
+
+var configPath string
+
+func init() {
+	flag.StringVar(&configPath, "config", "", "Location of a YAML config file describing dispatcher sets and runtime options.  Merged with any -set flags, which take precedence for a given set id.")
+}
+
+// Config is the top-level schema for the -config YAML file.  It mirrors the
+// CLI flags for anything global, and lets sets express options (a label
+// selector, weight, probing flags/attrs, an alternate socket, a custom
+// destination template) that the [namespace:]name=id[:port] flag syntax has
+// no room for.
+type Config struct {
+	Output  string `json:"output,omitempty"`
+	RPCHost string `json:"rpcHost,omitempty"`
+	RPCPort string `json:"rpcPort,omitempty"`
+	APIAddr string `json:"apiAddr,omitempty"`
+	KubeCfg string `json:"kubecfg,omitempty"`
+
+	Sets []SetConfig `json:"sets,omitempty"`
+
+	// Sinks configures additional Notifier subscribers for set-change
+	// events, beyond the always-present kamailio reload.  Each entry must
+	// set exactly one of Webhook, NATS, or File; an entry with none or with
+	// more than one is rejected.
+	Sinks []SinkConfig `json:"sinks,omitempty"`
+}
+
+// SinkConfig is one entry in Config.Sinks.
+type SinkConfig struct {
+	Webhook *WebhookSinkConfig `json:"webhook,omitempty"`
+	NATS    *NATSSinkConfig    `json:"nats,omitempty"`
+	File    *FileSinkConfig    `json:"file,omitempty"`
+}
+
+// WebhookSinkConfig configures an outbound HTTP webhook sink.
+type WebhookSinkConfig struct {
+	URL string `json:"url"`
+	// Secret, if set, HMAC-SHA256 signs the JSON body into the
+	// X-Dispatcher-Signature header.
+	Secret  string `json:"secret,omitempty"`
+	Timeout string `json:"timeout,omitempty"`
+}
+
+// NATSSinkConfig configures a NATS (or JetStream) publish sink.
+type NATSSinkConfig struct {
+	URL     string `json:"url,omitempty"`
+	Subject string `json:"subject"`
+}
+
+// FileSinkConfig configures an append-only JSON Lines audit file sink.
+type FileSinkConfig struct {
+	Path string `json:"path"`
+}
+
+// SetConfig describes a single dispatcher set.  Name identifies the backing
+// Kubernetes Service; the remaining fields control how the set is rendered
+// into dispatcher.list.
+//
+// NOTE: a label-selector alternative to Name was considered, but
+// sets.NewKubernetesSet only resolves a Service by name today, so it was
+// left out rather than shipping a config key that silently does nothing.
+type SetConfig struct {
+	ID        int    `json:"id"`
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name,omitempty"`
+	Port      string `json:"port,omitempty"`
+
+	// Weight, Flags, and Attrs fill in the corresponding parts of the
+	// dispatcher.list line (see the kamailio dispatcher module docs): Weight
+	// as a "=weight" suffix on host:port, Flags and Attrs as the following
+	// columns.  All three are optional and left out unless set.
+	Weight string `json:"weight,omitempty"`
+	Flags  string `json:"flags,omitempty"`
+	Attrs  string `json:"attrs,omitempty"`
+
+	// Socket overrides the kamailio listening socket used for this set's
+	// targets, e.g. "udp:10.0.0.1:5060".
+	Socket string `json:"socket,omitempty"`
+
+	// Destination is a text/template rendering one dispatcher.list line per
+	// host.  It is passed a struct with Host, Port, and the fields above; if
+	// empty, each host is rendered in the plain form of defaultDestination.
+	// A set that sets none of Weight, Flags, Attrs, Socket, or Destination
+	// is written with its DispatcherSet's own Export() instead.
+	Destination string `json:"destination,omitempty"`
+}
+
+// loadConfig reads and parses a YAML config file.
+func loadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path) // nolint: gosec
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read config file")
+	}
+
+	cfg := new(Config)
+	if err = yaml.Unmarshal(data, cfg); err != nil {
+		return nil, errors.Wrap(err, "failed to parse config file")
+	}
+
+	return cfg, nil
+}
+
+// mergeSetFlags overlays the legacy -set flags on top of the sets declared
+// in the config file, keyed by set id, so a -set flag can still override or
+// add to a checked-in config without editing it.  Overlaying only ever
+// touches the fields a -set flag can actually express (Namespace/Name/Port);
+// any Weight/Flags/Attrs/Socket/Destination already configured for that id
+// in the file carry forward untouched.
+func mergeSetFlags(base []SetConfig, flags []*SetDefinition) []SetConfig {
+	byID := make(map[int]SetConfig, len(base))
+	var order []int
+	for _, s := range base {
+		if _, ok := byID[s.ID]; !ok {
+			order = append(order, s.ID)
+		}
+		byID[s.ID] = s
+	}
+
+	for _, d := range flags {
+		sc, ok := byID[d.id]
+		if !ok {
+			order = append(order, d.id)
+		}
+
+		sc.ID = d.id
+		sc.Namespace = d.namespace
+		sc.Name = d.name
+		sc.Port = d.port
+
+		byID[d.id] = sc
+	}
+
+	merged := make([]SetConfig, 0, len(order))
+	for _, id := range order {
+		merged = append(merged, byID[id])
+	}
+	return merged
+}
+
+// destination renders the dispatcher.list line for a single host using the
+// set's Destination template, falling back to the plain
+// "id host:port=weight flags attrs socket" form kamailio expects when no
+// template is given.
+func (c SetConfig) destination(host string) (string, error) {
+	if c.Destination == "" {
+		return c.defaultDestination(host), nil
+	}
+
+	tmpl, err := template.New("destination").Parse(c.Destination)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to parse destination template")
+	}
+
+	var buf strings.Builder
+	data := struct {
+		SetConfig
+		Host string
+	}{SetConfig: c, Host: host}
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", errors.Wrap(err, "failed to render destination template")
+	}
+	return buf.String(), nil
+}
+
+func (c SetConfig) defaultDestination(host string) string {
+	line := fmt.Sprintf("%d %s:%s", c.ID, host, c.Port)
+	if c.Weight != "" {
+		line += "=" + c.Weight
+	}
+	if c.Flags != "" {
+		line += " " + c.Flags
+	}
+	if c.Attrs != "" {
+		line += " " + c.Attrs
+	}
+	if c.Socket != "" {
+		line += " " + c.Socket
+	}
+	return line + "\n"
+}
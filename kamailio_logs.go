@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ericchiang/k8s"
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+	"github.com/pkg/errors"
+)
+
+var kamailioSelector string
+
+func init() {
+	flag.StringVar(&kamailioSelector, "kamailio-selector", "", "Label selector for the kamailio pod(s) to tail logs from, e.g. 'app=kamailio'.  When set, DISPATCHER module log lines are parsed and surfaced as log entries and on the configured notifier sinks, giving a feedback channel even without binrpc read support.")
+}
+
+// dispatcherLogPattern recognizes the kamailio DISPATCHER module's
+// well-known log lines: reloads, list parse errors, and probing state
+// transitions.
+var dispatcherLogPattern = regexp.MustCompile(`DISPATCHER:\s*(\w+)\(\):\s*(.*)`)
+
+// dispatcherSetIDPattern picks the set id out of DISPATCHER messages that
+// reference one, e.g. "Destination ... in set 1 is disabled" or
+// "ds_mark_dst(): ... set=2 ...".  Other DISPATCHER lines (dispatcher.list
+// reloads, table parse errors) don't mention a set at all.
+var dispatcherSetIDPattern = regexp.MustCompile(`(?i)set[\s:=#]+(\d+)`)
+
+// kamailioLogNotifySetID is the sentinel SetID used for events derived from
+// kamailio log lines that don't reference a specific set, since e.g. a
+// dispatcher.list reload applies to the whole list rather than one set.
+const kamailioLogNotifySetID = -1
+
+// streamKamailioLogs tails every pod matching -kamailio-selector in
+// namespace and parses DISPATCHER module lines out of the stream, surfacing
+// each as both a structured log entry and a notifier event.  It is opt-in
+// and best-effort: individual pod streams are retried with runUntil, and a
+// failure to list or tail pods never affects the core reconcile loop.
+func streamKamailioLogs(ctx context.Context, kc *k8s.Client, namespace string, notifier Notifier) {
+	if kamailioSelector == "" {
+		return
+	}
+
+	runUntil(ctx, func() {
+		var pods corev1.PodList
+		if err := kc.List(ctx, namespace, &pods, k8s.QueryParam("labelSelector", kamailioSelector)); err != nil {
+			log.Println("kamailio log tail: failed to list kamailio pods:", err)
+			return
+		}
+
+		var wg sync.WaitGroup
+		for _, pod := range pods.Items {
+			name := pod.Metadata.GetName()
+			wg.Add(1)
+			go func(name string) {
+				defer wg.Done()
+				runUntil(ctx, func() {
+					if err := tailPodLog(ctx, kc, namespace, name, notifier); err != nil {
+						log.Printf("kamailio log tail: pod %s: %v", name, err)
+					}
+				})
+			}(name)
+		}
+		wg.Wait()
+	})
+}
+
+// tailPodLog streams a single pod's logs with follow=true and scans them
+// line by line for DISPATCHER module messages.
+func tailPodLog(ctx context.Context, kc *k8s.Client, namespace, pod string, notifier Notifier) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, podLogURL(kc, namespace, pod), nil)
+	if err != nil {
+		return errors.Wrap(err, "failed to build log request")
+	}
+
+	resp, err := kc.Client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "failed to start log stream")
+	}
+	defer resp.Body.Close() // nolint: errcheck
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("log stream returned status %d", resp.StatusCode)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		handleKamailioLogLine(ctx, pod, scanner.Text(), notifier)
+	}
+	return scanner.Err()
+}
+
+// podLogURL builds the /log subresource URL for a pod with follow=true,
+// since ericchiang/k8s has no typed helper for it.
+func podLogURL(kc *k8s.Client, namespace, pod string) string {
+	return fmt.Sprintf("%s/api/v1/namespaces/%s/pods/%s/log?follow=true", strings.TrimRight(kc.Endpoint, "/"), namespace, pod)
+}
+
+// handleKamailioLogLine parses a single log line for a DISPATCHER module
+// message and, if found, logs it with structured fields and publishes it to
+// the notifier so misconfigurations (bad dispatcher.list syntax,
+// unreachable gateways) are observable even without binrpc read support.
+func handleKamailioLogLine(ctx context.Context, pod, line string, notifier Notifier) {
+	m := dispatcherLogPattern.FindStringSubmatch(line)
+	if m == nil {
+		return
+	}
+
+	function, message := m[1], m[2]
+	setID := parseLogSetID(message)
+	log.Printf("kamailio[%s] DISPATCHER.%s: %s", pod, function, message)
+
+	if notifier == nil {
+		return
+	}
+
+	event := SetEvent{
+		SetID:     setID,
+		Hosts:     []string{message},
+		Timestamp: time.Now(),
+	}
+	if err := notifier.Notify(ctx, event); err != nil {
+		log.Println("kamailio log tail: failed to publish log event:", err)
+	}
+}
+
+// parseLogSetID extracts the dispatcher set id a DISPATCHER message refers
+// to (e.g. a probing or destination-state-change line naming "set 1"),
+// falling back to kamailioLogNotifySetID for messages that don't name one.
+func parseLogSetID(message string) int {
+	m := dispatcherSetIDPattern.FindStringSubmatch(message)
+	if m == nil {
+		return kamailioLogNotifySetID
+	}
+
+	id, err := strconv.Atoi(m[1])
+	if err != nil {
+		return kamailioLogNotifySetID
+	}
+	return id
+}
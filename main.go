@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
@@ -12,13 +13,14 @@ import (
 	"os/signal"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/CyCoreSystems/dispatchers/sets"
-	"github.com/CyCoreSystems/go-kamailio/binrpc"
 	"github.com/ericchiang/k8s"
 	"github.com/ghodss/yaml"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 
 	"github.com/pkg/errors"
 )
@@ -33,17 +35,6 @@ var minRuntime = time.Minute
 
 var apiAddr string
 
-// KamailioStartupDebounceTimer is the amount of time to wait on startup to
-// send an additional notify to kamailio.
-//
-// NOTE:  because we are notifying kamailio via UDP, we have no way of knowing
-// if it actually received the notification.  This debounce timer is a hack to
-// send a subsequent notification after kamailio should have had time to start.
-// Ideally, we should instead query kamailio to validate the dispatcher list.
-// However, our binrpc implementation does not yet support _reading_ from
-// binrpc.
-const KamailioStartupDebounceTimer = time.Minute
-
 func init() {
 	flag.Var(&setDefinitions, "set", "Dispatcher sets of the form [namespace:]name=index[:port], where index is a number and port is the port number on which SIP is to be signaled to the dispatchers.  May be passed multiple times for multiple sets.")
 	flag.StringVar(&outputFilename, "o", "/data/kamailio/dispatcher.list", "Output file for dispatcher list")
@@ -108,14 +99,10 @@ func (s *SetDefinition) Set(raw string) (err error) {
 	}
 
 	var id int
-	ns := "default"
+	ns := defaultNamespace()
 	var name string
 	port := "5060"
 
-	if os.Getenv("POD_NAMESPACE") != "" {
-		ns = os.Getenv("POD_NAMESPACE")
-	}
-
 	pieces := strings.SplitN(raw, "=", 2)
 	if len(pieces) < 2 {
 		return fmt.Errorf("failed to parse %s as the form [namespace:]name=index", raw)
@@ -155,6 +142,44 @@ type dispatcherSets struct {
 	rpcPort        string
 
 	sets map[int]sets.DispatcherSet
+
+	// exportMu serializes export(), since two reconcile workers can now run
+	// concurrently for different changed sets but both rewrite the same
+	// outputFilename in full.
+	exportMu sync.Mutex
+
+	// setConfigs holds the merged config-file/-set options of every set,
+	// keyed by id.  export() renders a set through them only when they go
+	// beyond the plain DispatcherSet.Export() output (weight, flags, attrs,
+	// socket, a custom destination template); otherwise it uses Export().
+	setConfigs map[int]SetConfig
+
+	// notifier receives a SetEvent whenever maintain reconciles a changed
+	// set; it always includes the kamailio reload sink plus whatever extra
+	// sinks were configured.
+	notifier Notifier
+
+	prevHostsMu sync.Mutex
+	prevHosts   map[int][]string
+
+	status notifyStatus
+
+	readyMu sync.RWMutex
+	ready   bool
+}
+
+// setReady records whether the initial update+export+notify sequence
+// succeeded, which gates /readyz.
+func (s *dispatcherSets) setReady(ready bool) {
+	s.readyMu.Lock()
+	defer s.readyMu.Unlock()
+	s.ready = ready
+}
+
+func (s *dispatcherSets) isReady() bool {
+	s.readyMu.RLock()
+	defer s.readyMu.RUnlock()
+	return s.ready
 }
 
 // add creates a dispatcher set from a k8s set definition
@@ -174,18 +199,36 @@ func (s *dispatcherSets) add(ctx context.Context, args *SetDefinition) error {
 	return nil
 }
 
-// export dumps the output from all dispatcher sets
+// export dumps the output from all dispatcher sets.  It is serialized with
+// exportMu because maintain can now reconcile multiple changed sets
+// concurrently, and each reconcile rewrites the whole of outputFilename.
 func (s *dispatcherSets) export() error {
+	s.exportMu.Lock()
+	defer s.exportMu.Unlock()
+
 	f, err := os.Create(s.outputFilename)
 	if err != nil {
 		return errors.Wrap(err, "failed to open dispatchers file for writing")
 	}
 	defer f.Close() // nolint: errcheck
 
-	for _, v := range s.sets {
-		_, err = f.WriteString(v.Export())
-		if err != nil {
-			return errors.Wrap(err, "failed to write to dispatcher file")
+	for id, v := range s.sets {
+		cfg, hasConfig := s.setConfigs[id]
+		if !hasConfig || (cfg.Weight == "" && cfg.Flags == "" && cfg.Attrs == "" && cfg.Socket == "" && cfg.Destination == "") {
+			if _, err = f.WriteString(v.Export()); err != nil {
+				return errors.Wrap(err, "failed to write to dispatcher file")
+			}
+			continue
+		}
+
+		for _, host := range v.Hosts() {
+			line, err := cfg.destination(host)
+			if err != nil {
+				return errors.Wrapf(err, "failed to render destination for set %d", id)
+			}
+			if _, err = f.WriteString(line); err != nil {
+				return errors.Wrap(err, "failed to write to dispatcher file")
+			}
 		}
 	}
 
@@ -202,46 +245,186 @@ func (s *dispatcherSets) update(ctx context.Context) error {
 	return nil
 }
 
+// maintainWorkers is the number of goroutines draining the reconcile
+// workqueue.  Reconciles are cheap (re-resolve one set, rewrite the whole
+// dispatcher.list, verify) so a small fixed pool is plenty even with many
+// sets.
+const maintainWorkers = 2
+
+// maintain watches every configured set and keeps outputFilename/kamailio in
+// sync with their membership.  It follows the informer+workqueue shape
+// common to Kubernetes controllers: each set gets its own watch loop
+// ("informer") that only ever pushes its id onto a shared, de-duplicating
+// workqueue; a small pool of workers drains the queue and does the actual
+// re-resolve/export/notify work.  A panic or watch error for one set is
+// contained to that set's loop (HandleCrash-style recovery, wait.Until-style
+// restart) instead of tearing down the whole process, and a burst of
+// Endpoint churn for a set coalesces into a single reconcile instead of one
+// per event.
 func (s *dispatcherSets) maintain(ctx context.Context) error {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	changes := make(chan error, 10)
+	queue := newSetWorkqueue()
+
+	var wg sync.WaitGroup
+
+	for id, v := range s.sets {
+		wg.Add(1)
+		go func(id int, ds sets.DispatcherSet) {
+			defer wg.Done()
+			runUntil(ctx, func() {
+				if _, err := ds.Watch(ctx); err != nil {
+					watchRestartsTotal.WithLabelValues(setIDLabel(id)).Inc()
+					if err == io.EOF {
+						log.Printf("set %d: kubernetes API connection terminated: %v", id, err)
+						return
+					}
+					log.Printf("set %d: watch error, will retry: %v", id, err)
+					return
+				}
+				queue.Add(id)
+			})
+		}(id, v)
+	}
 
-	// Listen to each of the namespaces
-	for _, v := range s.sets {
-		go func(ds sets.DispatcherSet) {
-			for {
-				_, err := ds.Watch(ctx)
-				changes <- err
-			}
-		}(v)
+	for i := 0; i < maintainWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.worker(ctx, queue)
+		}()
 	}
 
-	for ctx.Err() == nil {
-		err := <-changes
-		if err == io.EOF {
-			log.Println("kubernetes API connection terminated:", err)
-			return nil
-		}
-		if err != nil {
-			return errors.Wrap(err, "error maintaining sets")
-		}
+	<-ctx.Done()
+	// Workers only exit once Get reports shutdown, which only happens after
+	// ShutDown runs -- so it must happen before wg.Wait(), not after.
+	queue.ShutDown()
+	wg.Wait()
+	return ctx.Err()
+}
 
-		if err = s.export(); err != nil {
-			return errors.Wrap(err, "failed to export dispatcher set")
+// worker drains the reconcile queue until it is shut down, recovering from
+// any panic in a single reconcile so it cannot take down its sibling
+// workers.
+func (s *dispatcherSets) worker(ctx context.Context, queue *setWorkqueue) {
+	for {
+		id, shutdown := queue.Get()
+		if shutdown {
+			return
 		}
 
-		if err = s.notify(); err != nil {
-			return errors.Wrap(err, "failed to notify kamailio of update")
+		s.reconcile(ctx, queue, id)
+	}
+}
+
+// reconcile re-resolves a single set, rewrites the dispatcher list for all
+// sets, and verifies kamailio picked it up, requeuing the set with
+// rate-limited backoff on failure.
+func (s *dispatcherSets) reconcile(ctx context.Context, queue *setWorkqueue, id int) {
+	defer queue.Done(id)
+	defer handleCrash(fmt.Sprintf("set %d reconcile", id))
+
+	ds, ok := s.sets[id]
+	if !ok {
+		queue.Forget(id)
+		return
+	}
+
+	if _, err := ds.Update(ctx); err != nil {
+		log.Printf("set %d: failed to re-resolve, will retry: %v", id, err)
+		queue.AddRateLimited(id)
+		return
+	}
+
+	event := s.recordChange(id, ds.Hosts())
+
+	if err := s.notifier.Notify(ctx, event); err != nil {
+		log.Printf("set %d: failed to notify subscribers, will retry: %v", id, err)
+		queue.AddRateLimited(id)
+		return
+	}
+
+	queue.Forget(id)
+}
+
+// recordChange diffs a set's current hosts against the last hosts observed
+// for it and returns the resulting SetEvent, updating the stored snapshot
+// for next time.
+func (s *dispatcherSets) recordChange(id int, hosts []string) SetEvent {
+	s.prevHostsMu.Lock()
+	defer s.prevHostsMu.Unlock()
+
+	if s.prevHosts == nil {
+		s.prevHosts = make(map[int][]string)
+	}
+
+	added, removed := diffHosts(s.prevHosts[id], hosts)
+	s.prevHosts[id] = append([]string(nil), hosts...)
+
+	label := setIDLabel(id)
+	setSizeGauge.WithLabelValues(label).Set(float64(len(hosts)))
+	setLastUpdateGauge.WithLabelValues(label).Set(float64(time.Now().Unix()))
+	memberChangesTotal.WithLabelValues(label, "added").Add(float64(len(added)))
+	memberChangesTotal.WithLabelValues(label, "removed").Add(float64(len(removed)))
+
+	return SetEvent{
+		SetID:     id,
+		Added:     added,
+		Removed:   removed,
+		Hosts:     hosts,
+		Timestamp: time.Now(),
+	}
+}
+
+// runUntil repeatedly calls fn until ctx is done, recovering from any panic
+// and pausing briefly before restarting it, mirroring client-go's
+// wait.Until.
+func runUntil(ctx context.Context, fn func()) {
+	for ctx.Err() == nil {
+		func() {
+			defer handleCrash("watch loop")
+			fn()
+		}()
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second):
 		}
 	}
+}
 
-	return ctx.Err()
+// handleCrash recovers a panic from the named goroutine, logging it instead
+// of letting it take down the process.
+func handleCrash(name string) {
+	if r := recover(); r != nil {
+		log.Printf("recovered panic in %s: %v", name, r)
+	}
 }
 
 // ServeHTTP offers a web service by which clients may validate membership of an IP address within a dispatcher set
 func (s *dispatcherSets) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/status":
+		writeJSON(w, s.status.snapshot())
+		return
+	case "/healthz":
+		w.WriteHeader(http.StatusOK)
+		return
+	case "/readyz":
+		if s.isReady() {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	case "/metrics":
+		if metricsAddr == "" {
+			promhttp.Handler().ServeHTTP(w, r)
+			return
+		}
+	}
+
 	// Handle requests for /check/<setID>/<ip address> to validate membership of an IP to a dispatcher set
 	if strings.HasPrefix(r.URL.Path, "/check/") {
 		pieces := strings.Split(r.URL.Path, "/")
@@ -255,9 +438,11 @@ func (s *dispatcherSets) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		if s.validateSetMember(setID, pieces[2]) {
+			checkTotal.WithLabelValues(pieces[1], "member").Inc()
 			w.WriteHeader(http.StatusOK)
 			return
 		}
+		checkTotal.WithLabelValues(pieces[1], "not_member").Inc()
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
@@ -278,9 +463,14 @@ func (s *dispatcherSets) validateSetMember(id int, addr string) bool {
 	return false
 }
 
-// notify signals to kamailio to reload its dispatcher list
-func (s *dispatcherSets) notify() error {
-	return binrpc.InvokeMethod("dispatcher.reload", s.rpcHost, s.rpcPort)
+// writeJSON marshals v to the response as JSON, logging (rather than
+// failing loudly on) encode errors since the status line has already been
+// written by the time they can occur.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("failed to encode JSON response:", err)
+	}
 }
 
 func main() {
@@ -309,6 +499,16 @@ func run() error {
 
 	flag.Parse()
 
+	cfg := new(Config)
+	if configPath != "" {
+		var err error
+		if cfg, err = loadConfig(configPath); err != nil {
+			return errors.Wrap(err, "failed to load config file")
+		}
+	}
+	apiAddr = firstNonEmpty(cfg.APIAddr, apiAddr)
+	kubeCfg = firstNonEmpty(cfg.KubeCfg, kubeCfg)
+
 	kc, err := connect()
 	if err != nil {
 		fmt.Println("failed to create k8s client:", err.Error())
@@ -317,17 +517,42 @@ func run() error {
 
 	s := &dispatcherSets{
 		kc:             kc,
-		outputFilename: outputFilename,
-		rpcHost:        rpcHost,
-		rpcPort:        rpcPort,
+		outputFilename: firstNonEmpty(cfg.Output, outputFilename),
+		rpcHost:        firstNonEmpty(cfg.RPCHost, rpcHost),
+		rpcPort:        firstNonEmpty(cfg.RPCPort, rpcPort),
+		setConfigs:     make(map[int]SetConfig),
 	}
 
-	for _, v := range setDefinitions.list {
-		if err = s.add(ctx, v); err != nil {
+	for _, sc := range mergeSetFlags(cfg.Sets, setDefinitions.list) {
+		if sc.Name == "" {
+			return errors.Errorf("set %d: config must set name (a Kubernetes Service name)", sc.ID)
+		}
+		if sc.Namespace == "" {
+			sc.Namespace = defaultNamespace()
+		}
+
+		s.setConfigs[sc.ID] = sc
+
+		if err = s.add(ctx, &SetDefinition{id: sc.ID, namespace: sc.Namespace, name: sc.Name, port: sc.Port}); err != nil {
 			return errors.Wrap(err, "failed to add dispatcher set")
 		}
 	}
 
+	if s.notifier, err = buildNotifier(cfg, s); err != nil {
+		return errors.Wrap(err, "failed to configure notifier sinks")
+	}
+
+	logNotifier, err := buildLogNotifier(cfg)
+	if err != nil {
+		return errors.Wrap(err, "failed to configure log-derived notifier sinks")
+	}
+
+	kamailioNamespace := "default"
+	if ns := os.Getenv("POD_NAMESPACE"); ns != "" {
+		kamailioNamespace = ns
+	}
+	go streamKamailioLogs(ctx, kc, kamailioNamespace, logNotifier)
+
 	if err = s.update(ctx); err != nil {
 		return errors.Wrap(err, "failed to run initial dispatcher set update")
 	}
@@ -336,25 +561,24 @@ func run() error {
 		return errors.Wrap(err, "failed to run initial dispatcher set export")
 	}
 
-	if err = s.notify(); err != nil {
-		log.Println("NOTICE: failed to notify kamailio after initial dispatcher export; kamailio may not be up yet:", err)
-	}
+	serveMetrics(ctx)
 
-	// FIXME: quick hack to work around race condition where kamailio is not up
-	// before the notify is run.  Since binrpc is over UDP and returns no data,
-	// we have no idea whether the kamailio instance is actually up and
-	// receiving the notification.  Therefore, we send a notify again a little
-	// later, for good measure.
-	time.AfterFunc(KamailioStartupDebounceTimer, func() {
-		if err = s.notify(); err != nil {
-			log.Println("follow-up kamailio notification failed:", err)
+	// Run a web service to offer IP checks for each member of the dispatcher
+	// set.  This has to start before the initial verified notify below: that
+	// can block for up to verifyDeadline waiting on a kamailio that is slow
+	// to come up -- exactly the case /healthz and /readyz exist to let a k8s
+	// probe observe -- so it must not also hold up the port those probes hit.
+	if apiAddr != "" {
+		tlsCfg, err := apiTLSConfig()
+		if err != nil {
+			return errors.Wrap(err, "failed to configure TLS for web API")
 		}
-	})
 
-	// Run a web service to offer IP checks for each member of the dispatcher set
-	if apiAddr != "" {
-		var srv http.Server
-		srv.Addr = apiAddr
+		srv := http.Server{
+			Addr:      apiAddr,
+			Handler:   s,
+			TLSConfig: tlsCfg,
+		}
 
 		go func() {
 			<-ctx.Done()
@@ -363,24 +587,54 @@ func run() error {
 			}
 		}()
 		go func() {
-			if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+			if err := srv.ListenAndServeTLS("", ""); err != http.ErrServerClosed {
 				log.Fatalln("failed to start HTTP server:", err)
 			}
 		}()
 	}
 
-	for ctx.Err() == nil {
-		err = s.maintain(ctx)
-		if errors.Cause(err) == io.EOF {
-			continue
-		}
-		if err != nil {
-			return errors.Wrap(err, "failed to maintain dispatcher sets")
+	// The initial verified notify runs in the background so /readyz (false
+	// until it completes) is reachable immediately instead of gating the API
+	// server's startup on it.
+	go func() {
+		if err := s.notify(ctx); err != nil {
+			log.Println("NOTICE: failed to verify kamailio dispatcher reload after initial export:", err)
+			s.setReady(false)
+			return
 		}
+		s.setReady(true)
+	}()
+
+	// maintain blocks, reconciling sets as they change, until ctx is
+	// cancelled; per-set watch/reconcile failures are handled internally and
+	// never tear down the whole process.
+	if err = s.maintain(ctx); err != nil && errors.Cause(err) != context.Canceled {
+		return errors.Wrap(err, "failed to maintain dispatcher sets")
 	}
 	return nil
 }
 
+// defaultNamespace is the namespace a set falls back to when it doesn't name
+// one explicitly: POD_NAMESPACE if set (the usual case when running inside
+// the cluster whose Services it watches), otherwise "default".
+func defaultNamespace() string {
+	if ns := os.Getenv("POD_NAMESPACE"); ns != "" {
+		return ns
+	}
+	return "default"
+}
+
+// firstNonEmpty returns override if it is set, otherwise fallback.  run uses
+// it to let config-file values take the place of a CLI flag's value; it does
+// not distinguish a flag the operator actually passed from one left at its
+// default, so a value set in the config file wins over either.
+func firstNonEmpty(override, fallback string) string {
+	if override != "" {
+		return override
+	}
+	return fallback
+}
+
 func connect() (*k8s.Client, error) {
 	if os.Getenv("KUBERNETES_SERVICE_HOST") != "" {
 		return k8s.NewInClusterClient()
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var metricsAddr string
+
+func init() {
+	flag.StringVar(&metricsAddr, "metrics-addr", "", "Address on which to serve Prometheus metrics, e.g. ':9100'.  Defaults to serving /metrics on -api instead of a separate listener.")
+}
+
+var (
+	setSizeGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "dispatcher_set_size",
+		Help: "Number of hosts currently in a dispatcher set.",
+	}, []string{"set_id"})
+
+	setLastUpdateGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "dispatcher_set_last_update_timestamp_seconds",
+		Help: "Unix timestamp of the last successful resolve of a dispatcher set.",
+	}, []string{"set_id"})
+
+	reloadTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dispatcher_reload_total",
+		Help: "Count of kamailio dispatcher.reload attempts, by result.",
+	}, []string{"result"})
+
+	reloadDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name: "dispatcher_reload_duration_seconds",
+		Help: "Time taken to notify and verify a kamailio dispatcher.reload.",
+	})
+
+	watchRestartsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kubernetes_watch_restarts_total",
+		Help: "Count of times a dispatcher set's Kubernetes watch had to be restarted.",
+	}, []string{"set_id"})
+
+	memberChangesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dispatcher_set_member_changes_total",
+		Help: "Count of hosts added to or removed from a dispatcher set.",
+	}, []string{"set_id", "direction"})
+
+	checkTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dispatcher_check_total",
+		Help: "Count of /check requests, by set id and result.",
+	}, []string{"set_id", "result"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		setSizeGauge,
+		setLastUpdateGauge,
+		reloadTotal,
+		reloadDuration,
+		watchRestartsTotal,
+		memberChangesTotal,
+		checkTotal,
+	)
+}
+
+// serveMetrics starts a dedicated metrics listener when -metrics-addr is
+// set; otherwise /metrics is served by the -api server's ServeHTTP.
+func serveMetrics(ctx context.Context) {
+	if metricsAddr == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	srv := http.Server{Addr: metricsAddr, Handler: mux}
+
+	go func() {
+		<-ctx.Done()
+		srv.Shutdown(ctx) // nolint: errcheck
+	}()
+	go func() {
+		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatalln("failed to start metrics server:", err)
+		}
+	}()
+}
+
+// recordReload updates the reload counter and duration histogram for a
+// single notify() attempt.
+func recordReload(start time.Time, err error) {
+	reloadDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		reloadTotal.WithLabelValues("failure").Inc()
+		return
+	}
+	reloadTotal.WithLabelValues("success").Inc()
+}
+
+func setIDLabel(id int) string {
+	return strconv.Itoa(id)
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+)
+
+// SetEvent describes a single observed change to a dispatcher set, published
+// to every configured Notifier sink whenever maintain reconciles a set.  It
+// is also published for each DISPATCHER line read from kamailio's logs (see
+// handleKamailioLogLine); such an event carries the log message as its only
+// Hosts entry, no Added/Removed, and SetID kamailioLogNotifySetID when the
+// message names no set.
+type SetEvent struct {
+	SetID     int       `json:"setId"`
+	Added     []string  `json:"added,omitempty"`
+	Removed   []string  `json:"removed,omitempty"`
+	Hosts     []string  `json:"hosts"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Notifier is something that wants to know about dispatcher set changes.
+// Kamailio reload is just the default, in-tree subscriber (kamailioNotifier)
+// -- other systems (rate-limiters, billing, fraud detection) that today
+// scrape outputFilename can instead subscribe directly.
+type Notifier interface {
+	Notify(ctx context.Context, event SetEvent) error
+}
+
+// multiNotifier fans a single event out to every configured sink, running
+// them in parallel and returning a combined error if any sink fails so one
+// slow or broken sink can't block the others.
+type multiNotifier []Notifier
+
+func (m multiNotifier) Notify(ctx context.Context, event SetEvent) error {
+	errs := make([]error, len(m))
+
+	var wg sync.WaitGroup
+	for i, n := range m {
+		wg.Add(1)
+		go func(i int, n Notifier) {
+			defer wg.Done()
+			errs[i] = n.Notify(ctx, event)
+		}(i, n)
+	}
+	wg.Wait()
+
+	var combined error
+	for _, err := range errs {
+		if err == nil {
+			continue
+		}
+		if combined == nil {
+			combined = err
+			continue
+		}
+		combined = errors.Wrap(err, combined.Error())
+	}
+	return combined
+}
+
+// kamailioNotifier is the original behavior (export outputFilename, verify
+// kamailio picked it up) expressed as a Notifier sink, so it can sit
+// alongside any other configured sinks instead of being a special case.
+type kamailioNotifier struct {
+	sets *dispatcherSets
+}
+
+func (k kamailioNotifier) Notify(ctx context.Context, _ SetEvent) error {
+	if err := k.sets.export(); err != nil {
+		return errors.Wrap(err, "failed to export dispatcher set")
+	}
+	return k.sets.notify(ctx)
+}
+
+// webhookNotifier POSTs the event as JSON to an HTTP endpoint, signing the
+// body with HMAC-SHA256 over Secret so the receiver can authenticate it the
+// same way e.g. GitHub webhooks do.
+type webhookNotifier struct {
+	client *http.Client
+	url    string
+	secret []byte
+}
+
+func newWebhookNotifier(cfg WebhookSinkConfig) (*webhookNotifier, error) {
+	if cfg.URL == "" {
+		return nil, errors.New("webhook sink requires a url")
+	}
+
+	timeout := 5 * time.Second
+	if cfg.Timeout != "" {
+		d, err := time.ParseDuration(cfg.Timeout)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to parse webhook timeout")
+		}
+		timeout = d
+	}
+
+	return &webhookNotifier{
+		client: &http.Client{Timeout: timeout},
+		url:    cfg.URL,
+		secret: []byte(cfg.Secret),
+	}, nil
+}
+
+func (w *webhookNotifier) Notify(ctx context.Context, event SetEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal webhook payload")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "failed to build webhook request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	if len(w.secret) > 0 {
+		mac := hmac.New(sha256.New, w.secret)
+		mac.Write(body)
+		req.Header.Set("X-Dispatcher-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "failed to deliver webhook")
+	}
+	defer resp.Body.Close() // nolint: errcheck
+
+	if resp.StatusCode >= 300 {
+		return errors.Errorf("webhook sink received status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// natsNotifier publishes the event as JSON to a NATS (or JetStream, when the
+// subject has a matching stream) subject.
+type natsNotifier struct {
+	conn    *nats.Conn
+	subject string
+}
+
+func newNATSNotifier(cfg NATSSinkConfig) (*natsNotifier, error) {
+	if cfg.Subject == "" {
+		return nil, errors.New("nats sink requires a subject")
+	}
+
+	conn, err := nats.Connect(cfg.URL)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to connect to nats")
+	}
+
+	return &natsNotifier{conn: conn, subject: cfg.Subject}, nil
+}
+
+func (n *natsNotifier) Notify(_ context.Context, event SetEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal nats payload")
+	}
+	return errors.Wrap(n.conn.Publish(n.subject, body), "failed to publish to nats")
+}
+
+// fileNotifier appends the event, one JSON object per line, to an
+// append-only audit file.
+type fileNotifier struct {
+	mu   sync.Mutex
+	path string
+}
+
+func newFileNotifier(cfg FileSinkConfig) (*fileNotifier, error) {
+	if cfg.Path == "" {
+		return nil, errors.New("file sink requires a path")
+	}
+	return &fileNotifier{path: cfg.Path}, nil
+}
+
+func (f *fileNotifier) Notify(_ context.Context, event SetEvent) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	fh, err := os.OpenFile(f.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return errors.Wrap(err, "failed to open audit file")
+	}
+	defer fh.Close() // nolint: errcheck
+
+	line, err := json.Marshal(event)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal audit event")
+	}
+
+	_, err = fh.Write(append(line, '\n'))
+	return errors.Wrap(err, "failed to write audit event")
+}
+
+// buildNotifier assembles the kamailio sink (always present, so reload
+// behavior is unchanged by default) plus whatever sinks are configured.
+// This is the notifier maintain's reconcile loop publishes to.
+func buildNotifier(cfg *Config, s *dispatcherSets) (Notifier, error) {
+	sinks, err := buildConfiguredSinks(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return append(multiNotifier{kamailioNotifier{sets: s}}, sinks...), nil
+}
+
+// buildLogNotifier assembles only the configured sinks, deliberately
+// excluding the kamailio reload sink.  A dispatcher.reload we trigger
+// ourselves makes kamailio log a DISPATCHER: reload() line; publishing that
+// line back through a notifier that includes kamailioNotifier would trigger
+// another reload, which logs again, forever. Log-derived events must never
+// be able to cause a reload.
+func buildLogNotifier(cfg *Config) (Notifier, error) {
+	sinks, err := buildConfiguredSinks(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return multiNotifier(sinks), nil
+}
+
+// buildConfiguredSinks builds the Notifier sinks declared in cfg.Sinks.
+func buildConfiguredSinks(cfg *Config) ([]Notifier, error) {
+	var sinks []Notifier
+
+	for i, sink := range cfg.Sinks {
+		declared := 0
+		for _, isSet := range []bool{sink.Webhook != nil, sink.NATS != nil, sink.File != nil} {
+			if isSet {
+				declared++
+			}
+		}
+		if declared > 1 {
+			return nil, errors.Errorf("sink %d declares more than one of webhook, nats, or file config", i)
+		}
+
+		switch {
+		case sink.Webhook != nil:
+			n, err := newWebhookNotifier(*sink.Webhook)
+			if err != nil {
+				return nil, errors.Wrapf(err, "sink %d", i)
+			}
+			sinks = append(sinks, n)
+		case sink.NATS != nil:
+			n, err := newNATSNotifier(*sink.NATS)
+			if err != nil {
+				return nil, errors.Wrapf(err, "sink %d", i)
+			}
+			sinks = append(sinks, n)
+		case sink.File != nil:
+			n, err := newFileNotifier(*sink.File)
+			if err != nil {
+				return nil, errors.Wrapf(err, "sink %d", i)
+			}
+			sinks = append(sinks, n)
+		default:
+			return nil, errors.Errorf("sink %d declares no webhook, nats, or file config", i)
+		}
+	}
+
+	return sinks, nil
+}
+
+// diffHosts splits the difference between a set's previous and current
+// membership into added and removed hosts.
+func diffHosts(previous, current []string) (added, removed []string) {
+	prev := make(map[string]struct{}, len(previous))
+	for _, h := range previous {
+		prev[h] = struct{}{}
+	}
+	cur := make(map[string]struct{}, len(current))
+	for _, h := range current {
+		cur[h] = struct{}{}
+	}
+
+	for h := range cur {
+		if _, ok := prev[h]; !ok {
+			added = append(added, h)
+		}
+	}
+	for h := range prev {
+		if _, ok := cur[h]; !ok {
+			removed = append(removed, h)
+		}
+	}
+	return added, removed
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/CyCoreSystems/go-kamailio/binrpc"
+	"github.com/pkg/errors"
+)
+
+// verifyBackoffMin and verifyBackoffMax bound the exponential backoff used
+// while polling kamailio to confirm that a dispatcher.reload was actually
+// picked up.
+const (
+	verifyBackoffMin = 250 * time.Millisecond
+	verifyBackoffMax = 10 * time.Second
+)
+
+// verifyDeadline is the total amount of time notify will spend trying to
+// confirm that kamailio's in-memory dispatcher list matches what we wrote to
+// outputFilename before giving up and reporting the mismatch on /status.
+var verifyDeadline = 2 * time.Minute
+
+// notifyStatus is the last-known outcome of a verified notify, surfaced on
+// the /status HTTP endpoint so operators do not have to guess whether a SIP
+// routing change actually reached kamailio.
+type notifyStatus struct {
+	mu sync.RWMutex
+
+	Verified     bool      `json:"verified"`
+	LastAttempt  time.Time `json:"lastAttempt"`
+	LastVerified time.Time `json:"lastVerified"`
+	Attempts     int       `json:"attempts"`
+	Error        string    `json:"error,omitempty"`
+}
+
+func (n *notifyStatus) snapshot() notifyStatus {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return notifyStatus{
+		Verified:     n.Verified,
+		LastAttempt:  n.LastAttempt,
+		LastVerified: n.LastVerified,
+		Attempts:     n.Attempts,
+		Error:        n.Error,
+	}
+}
+
+func (n *notifyStatus) record(attempts int, verified bool, err error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.Attempts = attempts
+	n.LastAttempt = time.Now()
+	n.Verified = verified
+	if verified {
+		n.LastVerified = n.LastAttempt
+	}
+	if err != nil {
+		n.Error = err.Error()
+	} else {
+		n.Error = ""
+	}
+}
+
+// notify signals kamailio to reload its dispatcher list, then polls
+// dispatcher.list to confirm the reload actually took effect before
+// returning.  It retries with capped, jittered exponential backoff until the
+// lists match or ctx's deadline elapses, since binrpc over UDP gives no
+// delivery confirmation on its own.
+func (s *dispatcherSets) notify(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, verifyDeadline)
+	defer cancel()
+
+	want := s.exportedHosts()
+
+	var attempt int
+	var lastErr error
+
+	backoff := verifyBackoffMin
+	for {
+		attempt++
+		attemptStart := time.Now()
+
+		reloadErr := binrpc.InvokeMethod("dispatcher.reload", s.rpcHost, s.rpcPort)
+		if reloadErr != nil {
+			lastErr = errors.Wrap(reloadErr, "failed to invoke dispatcher.reload")
+		} else if got, err := queryDispatcherList(ctx, s.rpcHost, s.rpcPort); err != nil {
+			lastErr = errors.Wrap(err, "failed to query dispatcher.list")
+		} else if listsEqual(want, got) {
+			recordReload(attemptStart, nil)
+			s.status.record(attempt, true, nil)
+			return nil
+		} else {
+			lastErr = errors.New("kamailio dispatcher.list does not yet match exported sets")
+		}
+
+		recordReload(attemptStart, lastErr)
+		s.status.record(attempt, false, lastErr)
+
+		select {
+		case <-ctx.Done():
+			return errors.Wrap(lastErr, "gave up verifying dispatcher reload")
+		case <-time.After(jitter(backoff)):
+		}
+
+		backoff *= 2
+		if backoff > verifyBackoffMax {
+			backoff = verifyBackoffMax
+		}
+	}
+}
+
+// jitter returns d plus or minus up to 20%, so that a fleet of dispatchers
+// retrying in lockstep doesn't hammer kamailio at the same instant.
+func jitter(d time.Duration) time.Duration {
+	delta := time.Duration(rand.Int63n(int64(d) / 5))
+	if rand.Intn(2) == 0 {
+		return d + delta
+	}
+	return d - delta
+}
+
+// exportedHosts returns the set of hosts currently held in memory, keyed by
+// set id, in the same shape queryDispatcherList parses kamailio's reply
+// into.
+func (s *dispatcherSets) exportedHosts() map[int][]string {
+	out := make(map[int][]string, len(s.sets))
+	for id, ds := range s.sets {
+		hosts := append([]string(nil), ds.Hosts()...)
+		sort.Strings(hosts)
+		out[id] = hosts
+	}
+	return out
+}
+
+// queryDispatcherList calls kamailio's dispatcher.list RPC over TCP using
+// our own binrpc reply decoder (see binrpc_tcp.go) and parses the reply
+// into a map of set id to sorted member hosts.
+func queryDispatcherList(ctx context.Context, host, port string) (map[int][]string, error) {
+	records, err := queryTCP(ctx, host, port, "dispatcher.list")
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(map[int][]string)
+	for _, record := range records {
+		if err := collectDispatcherSets(record, out); err != nil {
+			return nil, errors.Wrap(err, "failed to decode dispatcher.list reply")
+		}
+	}
+
+	for id := range out {
+		sort.Strings(out[id])
+	}
+	return out, nil
+}
+
+// collectDispatcherSets walks one top-level reply record looking for
+// dispatcher set structs -- either a single SET/TARGETS struct, or an ARRAY
+// of them -- and adds their hosts to out.
+func collectDispatcherSets(record binrpcValue, out map[int][]string) error {
+	switch v := record.(type) {
+	case []binrpcValue:
+		for _, item := range v {
+			if err := collectDispatcherSets(item, out); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case map[string]binrpcValue:
+		idVal, ok := v["SET"].(int64)
+		if !ok {
+			return errors.New("dispatcher.list reply missing SET id")
+		}
+
+		targets, ok := v["TARGETS"].([]binrpcValue)
+		if !ok {
+			return errors.New("dispatcher.list reply missing TARGETS")
+		}
+
+		id := int(idVal)
+		for _, t := range targets {
+			target, ok := t.(map[string]binrpcValue)
+			if !ok {
+				continue
+			}
+			if dest, ok := target["DEST"].(string); ok {
+				out[id] = append(out[id], dest)
+			}
+		}
+		return nil
+
+	default:
+		return errors.Errorf("unexpected dispatcher.list reply record type %T", v)
+	}
+}
+
+// listsEqual compares two set-id-to-hosts maps for exact equality.
+func listsEqual(a, b map[int][]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for id, wantHosts := range a {
+		gotHosts, ok := b[id]
+		if !ok || len(gotHosts) != len(wantHosts) {
+			return false
+		}
+		for i, h := range wantHosts {
+			if gotHosts[i] != h {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"flag"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	tlsCertPath     string
+	tlsKeyPath      string
+	tlsClientCAPath string
+)
+
+func init() {
+	flag.StringVar(&tlsCertPath, "tls-cert", "", "Path to a TLS certificate for the web API.  If unset, a self-signed certificate is generated (and cached alongside outputFilename) on first run.")
+	flag.StringVar(&tlsKeyPath, "tls-key", "", "Path to the TLS private key for -tls-cert.")
+	flag.StringVar(&tlsClientCAPath, "tls-client-ca", "", "Path to a CA bundle used to verify client certificates on the web API, enabling mutual TLS for peers such as Kamailio/OpenSIPS.")
+}
+
+// apiTLSConfig builds the *tls.Config for the web API server: a
+// certificate, loaded from -tls-cert/-tls-key or generated and cached as a
+// self-signed cert next to outputFilename, plus optional client certificate
+// verification when -tls-client-ca is given.
+func apiTLSConfig() (*tls.Config, error) {
+	cert, err := loadOrGenerateCertificate(tlsCertPath, tlsKeyPath, outputFilename)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load or generate TLS certificate")
+	}
+
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if tlsClientCAPath != "" {
+		pool := x509.NewCertPool()
+		data, err := os.ReadFile(tlsClientCAPath)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read tls-client-ca")
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, errors.New("tls-client-ca did not contain any usable certificates")
+		}
+
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return cfg, nil
+}
+
+// loadOrGenerateCertificate loads certPath/keyPath if both are given,
+// otherwise loads a previously-generated self-signed cert/key cached next to
+// outputPath, generating and persisting a new one on first run.
+func loadOrGenerateCertificate(certPath, keyPath, outputPath string) (tls.Certificate, error) {
+	if certPath != "" && keyPath != "" {
+		return tls.LoadX509KeyPair(certPath, keyPath)
+	}
+
+	dir := filepath.Dir(outputPath)
+	cachedCert := filepath.Join(dir, "cert.pem")
+	cachedKey := filepath.Join(dir, "key.pem")
+
+	if _, err := os.Stat(cachedCert); err == nil {
+		if _, err := os.Stat(cachedKey); err == nil {
+			return tls.LoadX509KeyPair(cachedCert, cachedKey)
+		}
+	}
+
+	return generateAndSave(cachedCert, cachedKey)
+}
+
+// generateAndSave creates a self-signed RSA certificate/key pair valid for
+// one year and writes them to certPath/keyPath before returning the usable
+// tls.Certificate.
+func generateAndSave(certPath, keyPath string) (tls.Certificate, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return tls.Certificate{}, errors.Wrap(err, "failed to generate private key")
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, errors.Wrap(err, "failed to generate certificate serial number")
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "dispatchers"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:                  false,
+		BasicConstraintsValid: true,
+		DNSNames:              dnsNames(),
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, errors.Wrap(err, "failed to create self-signed certificate")
+	}
+
+	certOut, err := os.OpenFile(certPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return tls.Certificate{}, errors.Wrap(err, "failed to open cert.pem for writing")
+	}
+	defer certOut.Close() // nolint: errcheck
+	if err := pem.Encode(certOut, &pem.Block{Type: "CERTIFICATE", Bytes: der}); err != nil {
+		return tls.Certificate{}, errors.Wrap(err, "failed to write cert.pem")
+	}
+
+	keyOut, err := os.OpenFile(keyPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return tls.Certificate{}, errors.Wrap(err, "failed to open key.pem for writing")
+	}
+	defer keyOut.Close() // nolint: errcheck
+	if err := pem.Encode(keyOut, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}); err != nil {
+		return tls.Certificate{}, errors.Wrap(err, "failed to write key.pem")
+	}
+
+	return tls.LoadX509KeyPair(certPath, keyPath)
+}
+
+// dnsNames returns the Subject Alternative Names to embed in a generated
+// certificate.  Go 1.15+ rejects CN-only certs for hostname verification, so
+// without a SAN entry matching what a client dials, the generated cert is
+// unverifiable by anything that doesn't disable verification.
+func dnsNames() []string {
+	names := []string{"localhost"}
+	if hostname, err := os.Hostname(); err == nil && hostname != "" {
+		names = append(names, hostname)
+	}
+	return names
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"container/list"
+	"math"
+	"sync"
+	"time"
+)
+
+// setWorkqueue is a minimal stand-in for client-go's
+// workqueue.RateLimitingInterface, scoped down to the one key type we need
+// (a dispatcher set id).  It de-duplicates keys that are added while already
+// queued or in-flight, so a burst of Endpoint churn for the same set
+// collapses into a single reconcile rather than N.
+type setWorkqueue struct {
+	mu sync.Mutex
+
+	queue      *list.List
+	dirty      map[int]struct{} // keys waiting in queue, or re-added while processing
+	processing map[int]struct{} // keys currently being worked on
+
+	failures map[int]int // consecutive failure count, for rate-limited requeues
+
+	cond   *sync.Cond
+	closed bool
+}
+
+func newSetWorkqueue() *setWorkqueue {
+	q := &setWorkqueue{
+		queue:      list.New(),
+		dirty:      make(map[int]struct{}),
+		processing: make(map[int]struct{}),
+		failures:   make(map[int]int),
+	}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// Add enqueues id for processing, coalescing it with any identical key
+// already waiting.  Following client-go's workqueue.Type, if id is currently
+// being processed (between Get and Done), it is only marked dirty and is
+// not pushed onto queue again here -- Done re-adds it once the in-flight
+// reconcile finishes, so the same id is never worked on by two goroutines
+// at once.
+func (q *setWorkqueue) Add(id int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return
+	}
+	if _, dup := q.dirty[id]; dup {
+		return
+	}
+	q.dirty[id] = struct{}{}
+
+	if _, inFlight := q.processing[id]; inFlight {
+		return
+	}
+
+	q.queue.PushBack(id)
+	q.cond.Signal()
+}
+
+// AddAfter enqueues id after the given delay, used to implement rate-limited
+// requeues on failure.
+func (q *setWorkqueue) AddAfter(id int, delay time.Duration) {
+	time.AfterFunc(delay, func() { q.Add(id) })
+}
+
+// AddRateLimited enqueues id after a delay that grows exponentially (capped)
+// with the number of consecutive AddRateLimited calls for it since the last
+// Forget.
+func (q *setWorkqueue) AddRateLimited(id int) {
+	q.mu.Lock()
+	q.failures[id]++
+	n := q.failures[id]
+	q.mu.Unlock()
+
+	delay := time.Duration(float64(workqueueBaseDelay) * math.Pow(2, float64(n-1)))
+	if delay > workqueueMaxDelay {
+		delay = workqueueMaxDelay
+	}
+	q.AddAfter(id, delay)
+}
+
+// Forget clears the failure count for id, to be called once it has been
+// processed successfully.
+func (q *setWorkqueue) Forget(id int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.failures, id)
+}
+
+// Get blocks until a key is available and returns it, marking it as
+// in-flight.  The second return value is true once the queue has been shut
+// down and drained.
+func (q *setWorkqueue) Get() (id int, shutdown bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for q.queue.Len() == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if q.queue.Len() == 0 && q.closed {
+		return 0, true
+	}
+
+	front := q.queue.Front()
+	q.queue.Remove(front)
+	id = front.Value.(int)
+
+	q.processing[id] = struct{}{}
+	delete(q.dirty, id)
+
+	return id, false
+}
+
+// Done marks id as finished processing.  If id was re-added (via Add) while
+// it was in flight, it is pushed back onto queue now instead of being lost,
+// so a change that arrived mid-reconcile still gets picked up.
+func (q *setWorkqueue) Done(id int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	delete(q.processing, id)
+
+	if _, stillDirty := q.dirty[id]; stillDirty {
+		q.queue.PushBack(id)
+		q.cond.Signal()
+	}
+}
+
+// ShutDown causes Get to unblock and return shutdown=true once the queue is
+// drained.
+func (q *setWorkqueue) ShutDown() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.cond.Broadcast()
+}
+
+const (
+	workqueueBaseDelay = 5 * time.Millisecond
+	workqueueMaxDelay  = 30 * time.Second
+)